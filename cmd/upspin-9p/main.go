@@ -0,0 +1,64 @@
+// Copyright 2016 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command upspin-9p serves a filesystem.Server tree over 9P2000.L, so
+// it can be mounted directly with `mount -t 9p`, without an Upspin
+// FUSE client.
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"os"
+
+	"github.com/hugelgupf/p9/p9"
+
+	"upspin.io/config"
+
+	"github.com/gildasch/exp/filesystem"
+	"github.com/gildasch/exp/filesystem/ninep"
+)
+
+func main() {
+	root := flag.String("root", "", "local directory to serve")
+	configFile := flag.String("config", "", "path to an Upspin config file naming the identity to serve as")
+	addr := flag.String("addr", "", "TCP address to serve on, e.g. :5640 (mutually exclusive with -socket)")
+	socket := flag.String("socket", "", "Unix socket path to serve on, e.g. /tmp/upspin.9p")
+	flag.Parse()
+
+	if *root == "" {
+		log.Fatal("upspin-9p: -root is required")
+	}
+	if (*addr == "") == (*socket == "") {
+		log.Fatal("upspin-9p: exactly one of -addr or -socket is required")
+	}
+
+	cfg, err := config.FromFile(*configFile)
+	if err != nil {
+		log.Fatalf("upspin-9p: loading config: %v", err)
+	}
+
+	fs, err := filesystem.New(cfg, *root)
+	if err != nil {
+		log.Fatalf("upspin-9p: %v", err)
+	}
+	defer fs.Close()
+
+	srv := p9.NewServer(ninep.New(fs, cfg))
+
+	var l net.Listener
+	if *socket != "" {
+		os.Remove(*socket)
+		l, err = net.Listen("unix", *socket)
+	} else {
+		l, err = net.Listen("tcp", *addr)
+	}
+	if err != nil {
+		log.Fatalf("upspin-9p: %v", err)
+	}
+
+	log.Printf("upspin-9p: serving %s on %s", *root, l.Addr())
+	log.Fatal(srv.Serve(l))
+}
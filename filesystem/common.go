@@ -7,22 +7,36 @@
 package filesystem // import "github.com/gildasch/exp/filesystem"
 
 import (
-	"io/ioutil"
+	"log"
 	"os"
 	gPath "path"
 	"path/filepath"
+	"sync"
 
 	"upspin.io/access"
 	"upspin.io/cache"
 	"upspin.io/errors"
+	_ "upspin.io/pack/ee"
+	_ "upspin.io/pack/eeintegrity"
 	_ "upspin.io/pack/plain"
 	"upspin.io/path"
 	"upspin.io/upspin"
+
+	"github.com/gildasch/exp/filesystem/compression"
 )
 
 const (
-	packing         = upspin.PlainPack
+	defaultPacking  = upspin.PlainPack
 	maxCacheEntries = 10000
+
+	// maxBlockSize bounds the size of a single block accepted by
+	// storeServer.Put. Larger payloads must be split by the client
+	// into multiple blocks, same as any other upspin store.
+	maxBlockSize = 1 << 20 // 1MB
+
+	// blobDir is where storeServer.Put stages block contents before
+	// dirServer.Put moves them into their final, named location.
+	blobDir = ".exp-blobs"
 )
 
 var errReadOnly = errors.Str("read-only name space")
@@ -35,39 +49,141 @@ type Server struct {
 	root          string
 	defaultAccess *access.Access
 	dirEntries    *cache.LRU
+	packing       upspin.Packing
+	readOnly      bool
+	quota         int64 // 0 means unlimited; immutable after New, so safe to copy.
+	index         *contentIndex
+	hub           *watchHub
+	compression   compression.Algorithm
+	fs            Fs
+
+	// qs holds all the mutable quota/refcount bookkeeping behind one
+	// mutex. It's a pointer so that Dial's "dialed := *s.Server" struct
+	// copy -- made once per dialed client -- shares this state rather
+	// than forking its own independent mutex, counter and maps.
+	qs *quotaState
 
 	// Set by Dial.
 	user upspin.Config
 }
 
+// quotaState is Server's mutable quota/refcount bookkeeping: the
+// running byte count Put/Delete charge and refund, and every refcount
+// map keyed by content reference or local path.
+type quotaState struct {
+	mu       sync.Mutex
+	used     int64                   // bytes written so far; accessed atomically.
+	blobRefs map[string]int          // content reference -> number of staged Puts not yet consumed by writeBlocks.
+	liveRefs map[string]int          // content reference -> number of on-disk files currently holding it.
+	fileRefs map[string][]contentRef // local file path -> content references its blocks were last committed under.
+}
+
+func newQuotaState() *quotaState {
+	return &quotaState{
+		blobRefs: make(map[string]int),
+		liveRefs: make(map[string]int),
+		fileRefs: make(map[string][]contentRef),
+	}
+}
+
+// An Option configures optional behavior of a Server returned by New.
+type Option func(*Server)
+
+// WithPacking sets the packing used for entries written through this
+// Server's DirServer and StoreServer. The default is upspin.PlainPack,
+// which preserves the historical behavior of signing entries with a
+// dkey=0, sum=0 placeholder. Use upspin.EEPack or upspin.EEIntegrityPack
+// to have entries carry real per-block AES keys, wrapped for the dialed
+// user only; readers listed in the enclosing Access file get no key.
+func WithPacking(p upspin.Packing) Option {
+	return func(s *Server) { s.packing = p }
+}
+
+// WithCompression sets the default compression algorithm used by
+// storeServer.Get. A per-request override can still be given as a
+// "-gzip" or "-zstd" suffix on the requested reference. The default is
+// compression.Uncompressed.
+func WithCompression(algo compression.Algorithm) Option {
+	return func(s *Server) { s.compression = algo }
+}
+
+// WithFS overrides the Fs backing Server's reads of root, in place of
+// the default osFS. Use memFS in tests to avoid touching a real disk,
+// or an overlayFS to composite a read-only patch tree over a base one.
+func WithFS(fs Fs) Option {
+	return func(s *Server) { s.fs = fs }
+}
+
+// WithQuota limits the total number of bytes that may be written under
+// root via Put. A quota of 0 (the default) means unlimited.
+func WithQuota(bytes int64) Option {
+	return func(s *Server) { s.quota = bytes }
+}
+
+// ReadOnly disables Put and Delete on both the DirServer and
+// StoreServer, restoring the original read-only behavior of this
+// package. It is the default.
+func ReadOnly() Option {
+	return func(s *Server) { s.readOnly = true }
+}
+
+// Writable enables Put and Delete on both the DirServer and
+// StoreServer.
+func Writable() Option {
+	return func(s *Server) { s.readOnly = false }
+}
+
 // New creates a new filesystem Server instance serving the
 // given root with the provided server configuration.
-func New(cfg upspin.Config, root string) (*Server, error) {
+func New(cfg upspin.Config, root string, opts ...Option) (*Server, error) {
 	const op errors.Op = "exp/filesystem.New"
 
 	root = filepath.Clean(root)
 	if !filepath.IsAbs(root) {
 		return nil, errors.E(op, errors.Invalid, "root must be an absolute path")
 	}
-	if fi, err := os.Stat(root); os.IsNotExist(err) {
-		return nil, errors.E(op, errors.NotExist, err)
-	} else if err != nil {
-		return nil, errors.E(op, errors.IO, err)
-	} else if !fi.IsDir() {
-		return nil, errors.E(op, "root must be a directory")
-	}
 
 	defaultAccess, err := access.New(upspin.PathName(cfg.UserName()) + "/Access")
 	if err != nil {
 		return nil, errors.E(op, err)
 	}
 
-	return &Server{
+	s := &Server{
 		server:        cfg,
 		root:          root,
 		defaultAccess: defaultAccess,
 		dirEntries:    cache.NewLRU(maxCacheEntries),
-	}, nil
+		packing:       defaultPacking,
+		readOnly:      true,
+		fs:            osFS{},
+		qs:            newQuotaState(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	// Built after opts so that a WithFS override is honored by digesting.
+	s.index = newContentIndex(root, s.fs)
+
+	if fi, err := s.fs.Stat(root); os.IsNotExist(err) {
+		return nil, errors.E(op, errors.NotExist, err)
+	} else if err != nil {
+		return nil, errors.E(op, errors.IO, err)
+	} else if !fi.IsDir() {
+		return nil, errors.E(op, "root must be a directory")
+	}
+
+	hub, err := newWatchHub(s, s.index)
+	if err != nil {
+		// Digests still work without a watcher; they just won't be
+		// invalidated on external changes to root until recomputed
+		// for an unrelated reason (e.g. process restart), and Watch
+		// will report upspin.ErrNotSupported rather than deliver events.
+		log.Printf("exp/filesystem: watching %s: %v; digests may go stale", root, err)
+	} else {
+		s.hub = hub
+	}
+
+	return s, nil
 }
 
 func (s *Server) Ping() bool {
@@ -75,6 +191,9 @@ func (s *Server) Ping() bool {
 }
 
 func (s *Server) Close() {
+	if s.hub != nil {
+		s.hub.Close()
+	}
 }
 
 func (s *Server) Endpoint() upspin.Endpoint {
@@ -108,13 +227,24 @@ func (s *Server) whichAccess(parsed path.Parsed) (upspin.PathName, error) {
 	// Look for Access file starting at end of local path.
 	for i := 0; i <= parsed.NElem(); i++ {
 		dir := filepath.Join(s.root, filepath.FromSlash(parsed.Drop(i).FilePath()))
-		if fi, err := os.Stat(dir); err != nil {
+		// At i == 0, dir is the requested path itself, which may be a
+		// symlink -- possibly a dangling one -- rather than a
+		// directory; Lstat it so a dangling target doesn't fail the
+		// lookup outright before the loop gets a chance to continue
+		// up to an ancestor directory. Ancestor elements (i > 0) are
+		// expected to be real directories, so Stat (which follows
+		// symlinks) is still correct there.
+		stat := s.fs.Stat
+		if i == 0 {
+			stat = s.fs.Lstat
+		}
+		if fi, err := stat(dir); err != nil {
 			return "", err
 		} else if !fi.IsDir() {
 			continue
 		}
 		name := filepath.Join(dir, "Access")
-		fi, err := os.Stat(name)
+		fi, err := s.fs.Stat(name)
 		// Must exist and be a plain file.
 		if os.IsNotExist(err) {
 			continue
@@ -127,7 +257,7 @@ func (s *Server) whichAccess(parsed path.Parsed) (upspin.PathName, error) {
 		if !fi.Mode().IsRegular() {
 			return "", errors.Errorf("%q is not a regular file", accessFile)
 		}
-		fd, err := os.Open(name)
+		fd, err := s.fs.Open(name)
 		if err != nil {
 			// File exists but cannot be read.
 			return "", err
@@ -147,7 +277,17 @@ func (s *Server) readFile(name upspin.PathName) ([]byte, error) {
 		return nil, err
 	}
 	localName := filepath.Join(s.root, parsed.FilePath())
-	info, err := os.Stat(localName)
+
+	// A symbolic link is only safe to read through if it (and any
+	// links in its own target chain) stays within root; resolveLink
+	// does that check without requiring us to change what gets read.
+	if lst, lerr := s.fs.Lstat(localName); lerr == nil && lst.Mode()&os.ModeSymlink != 0 {
+		if _, err := s.resolveLink(localName); err != nil {
+			return nil, err
+		}
+	}
+
+	info, err := s.fs.Stat(localName)
 	if err != nil {
 		return nil, err
 	}
@@ -161,6 +301,5 @@ func (s *Server) readFile(name upspin.PathName) ([]byte, error) {
 		return nil, errors.E(errors.Permission, "not world-readable", name)
 	}
 
-	// TODO(r, adg): think about symbolic links.
-	return ioutil.ReadFile(localName)
+	return s.fs.ReadFile(localName)
 }
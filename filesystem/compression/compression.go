@@ -0,0 +1,133 @@
+// Copyright 2016 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package compression provides pluggable, sniffing-aware compression
+// for block data, modeled on containerd's archive/compression
+// package: callers ask for an Algorithm and get that algorithm's
+// bytes back, unless the source was already compressed, in which case
+// it passes through untouched and the algorithm it carries is reported.
+package compression
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Algorithm identifies a block compression scheme.
+type Algorithm int
+
+const (
+	// Uncompressed passes data through unchanged.
+	Uncompressed Algorithm = iota
+	// Gzip compresses with compress/gzip.
+	Gzip
+	// Zstd compresses with github.com/klauspost/compress/zstd.
+	Zstd
+)
+
+func (a Algorithm) String() string {
+	switch a {
+	case Gzip:
+		return "gzip"
+	case Zstd:
+		return "zstd"
+	default:
+		return "uncompressed"
+	}
+}
+
+// ParseAlgorithm maps a reference suffix such as "gzip" or "zstd",
+// as used in a store reference override, to an Algorithm.
+func ParseAlgorithm(s string) (Algorithm, bool) {
+	switch s {
+	case "gzip":
+		return Gzip, true
+	case "zstd":
+		return Zstd, true
+	}
+	return Uncompressed, false
+}
+
+// Magic byte sequences used to detect already-compressed data.
+var (
+	gzipMagic = []byte{0x1F, 0x8B, 0x08}
+	zstdMagic = []byte{0x28, 0xB5, 0x2F, 0xFD}
+)
+
+// DetectCompression sniffs the leading bytes of data and reports
+// which algorithm, if any, already compressed it. It returns
+// Uncompressed if no known magic is found.
+func DetectCompression(data []byte) Algorithm {
+	switch {
+	case bytes.HasPrefix(data, gzipMagic):
+		return Gzip
+	case bytes.HasPrefix(data, zstdMagic):
+		return Zstd
+	}
+	return Uncompressed
+}
+
+// readerPool pools bufio.Readers sized to the block size we stream in
+// chunks of, so Compress doesn't allocate a fresh 32KiB buffer on
+// every call.
+var readerPool = sync.Pool{
+	New: func() interface{} { return bufio.NewReaderSize(nil, 32*1024) },
+}
+
+// Compress reads all of src and writes it to dst using algo,
+// returning the algorithm the bytes actually ended up in. If the
+// first bytes of src already carry any known magic, whatever algo is,
+// the data is copied through untouched instead of being compressed
+// again, and the sniffed algorithm is returned.
+func Compress(dst io.Writer, src io.Reader, algo Algorithm) (Algorithm, error) {
+	br := readerPool.Get().(*bufio.Reader)
+	br.Reset(src)
+	defer func() {
+		br.Reset(nil)
+		readerPool.Put(br)
+	}()
+
+	peek, err := br.Peek(4)
+	if err != nil && err != io.EOF {
+		return Uncompressed, err
+	}
+	sniffed := DetectCompression(peek)
+	if sniffed != Uncompressed {
+		// Already compressed; never double-compress, and never
+		// decompress just to satisfy a different target algorithm.
+		_, err := io.Copy(dst, br)
+		return sniffed, err
+	}
+
+	switch algo {
+	case Uncompressed:
+		_, err := io.Copy(dst, br)
+		return Uncompressed, err
+	case Gzip:
+		w := gzip.NewWriter(dst)
+		if _, err := io.Copy(w, br); err != nil {
+			w.Close()
+			return Uncompressed, err
+		}
+		return Gzip, w.Close()
+	case Zstd:
+		w, err := zstd.NewWriter(dst)
+		if err != nil {
+			return Uncompressed, err
+		}
+		if _, err := io.Copy(w, br); err != nil {
+			w.Close()
+			return Uncompressed, err
+		}
+		return Zstd, w.Close()
+	default:
+		return Uncompressed, fmt.Errorf("compression: unknown algorithm %d", algo)
+	}
+}
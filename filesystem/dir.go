@@ -5,17 +5,15 @@
 package filesystem
 
 import (
-	"crypto/sha256"
-	"encoding/binary"
 	"fmt"
-	"math/big"
+	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
 
 	"upspin.io/access"
 	"upspin.io/errors"
-	"upspin.io/pack/packutil"
 	"upspin.io/path"
 	"upspin.io/serverutil"
 	"upspin.io/upspin"
@@ -30,6 +28,11 @@ type dirServer struct {
 	*Server
 }
 
+// Dial returns a dirServer bound to cfg. The Server struct is copied
+// by value -- a fresh one per dialed client -- but Server.qs, the
+// quota/refcount bookkeeping, is a pointer, so every dial of the same
+// Server still shares one mutex, one byte count and one set of
+// refcount maps, rather than each dial silently resetting its own.
 func (s dirServer) Dial(cfg upspin.Config, e upspin.Endpoint) (upspin.Service, error) {
 	dialed := *s.Server
 	dialed.user = cfg
@@ -63,20 +66,25 @@ func (s dirServer) Lookup(pathName upspin.PathName) (*upspin.DirEntry, error) {
 	if err != nil {
 		return nil, errors.E(op, err)
 	}
+	if e.IsLink() {
+		return e, upspin.ErrFollowLink
+	}
 	return e, nil
 }
 
 // entry returns the DirEntry for the named local file or directory.
 func (s dirServer) entry(file string) (*upspin.DirEntry, error) {
-	// TODO(adg): handle symbolic links
 	if !strings.HasPrefix(file, s.root) {
 		return nil, errors.Str("internal error: not in root")
 	}
 
-	info, err := os.Stat(file)
+	info, err := s.fs.Lstat(file)
 	if err != nil {
 		return nil, err
 	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return s.linkEntry(file, info)
+	}
 	modTime := upspin.TimeFromGo(info.ModTime())
 
 	attr := upspin.AttrNone
@@ -98,14 +106,17 @@ func (s dirServer) entry(file string) (*upspin.DirEntry, error) {
 	entry := &upspin.DirEntry{
 		Name:       name,
 		SignedName: name,
-		Packing:    packing,
+		Packing:    s.packing,
 		Time:       modTime,
 		Attr:       attr,
 		Sequence:   0,
 		Writer:     s.server.UserName(), // TODO: Is there a better answer?
 	}
 	if info.IsDir() {
-		// Nothing left to do.
+		// Lazily extend the watch to this directory now that it's
+		// been discovered, rather than pre-walking the whole tree at
+		// startup (see watchHub.ensureWatched).
+		s.hub.ensureWatched(file)
 		return entry, nil
 	}
 
@@ -114,26 +125,36 @@ func (s dirServer) entry(file string) (*upspin.DirEntry, error) {
 		return nil, err
 	}
 
+	digest, err := s.index.digest(file)
+	if err != nil {
+		return nil, err
+	}
+
 	entry.Blocks = []upspin.DirBlock{upspin.DirBlock{
 		Location: upspin.Location{
 			Endpoint:  s.server.StoreEndpoint(),
-			Reference: upspin.Reference(file[len(s.root):]),
+			Reference: upspin.Reference(digest),
 		},
 		Offset: offs,
 		Size:   info.Size(),
 	}}
 
-	// Compute entry signature with dkey=sum=0.
-	dkey := make([]byte, aesKeyLen)
-	sum := make([]byte, sha256.Size)
-	sig, err := s.user.Factotum().FileSign(s.user.Factotum().DirEntryHash(entry.SignedName, entry.Link, entry.Attr, entry.Packing, entry.Time, dkey, sum))
-	if err != nil {
-		return nil, err
-	}
-
-	err = pdMarshal(&entry.Packdata, sig, upspin.Signature{})
-	if err != nil {
-		return nil, err
+	switch entry.Packing {
+	case upspin.EEPack, upspin.EEIntegrityPack:
+		// eeSign wraps a real per-block AES key for s.user, rather
+		// than the dkey=0, sum=0 placeholder used for plain packing;
+		// it does not consult the Access file covering file.
+		cleartext, err := s.fs.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if err := eeSign(s.user, entry, cleartext); err != nil {
+			return nil, err
+		}
+	default:
+		if err := simplePack(s.user, entry); err != nil {
+			return nil, err
+		}
 	}
 
 	s.dirEntries.Add(file, entry)
@@ -144,36 +165,63 @@ func (s dirServer) entry(file string) (*upspin.DirEntry, error) {
 	return entry, nil
 }
 
-const (
-	aesKeyLen     = 32
-	marshalBufLen = 66
-)
+// linkEntry builds the DirEntry for a symbolic link at file, rewriting
+// its target into the Upspin namespace via resolveLink. Per the
+// Upspin protocol, Lookup and Glob turn an AttrLink entry like this
+// into upspin.ErrFollowLink for the caller to chase.
+func (s dirServer) linkEntry(file string, info os.FileInfo) (*upspin.DirEntry, error) {
+	target, err := s.resolveLink(file)
+	if err != nil {
+		return nil, err
+	}
+	name := s.upspinPathFromLocal(file)
+	return &upspin.DirEntry{
+		Name:       name,
+		SignedName: name,
+		Packing:    s.packing,
+		Time:       upspin.TimeFromGo(info.ModTime()),
+		Attr:       upspin.AttrLink,
+		Link:       target,
+		Writer:     s.server.UserName(),
+	}, nil
+}
 
-var (
-	zero = big.NewInt(0)
-)
+// resolveLink returns the Upspin-namespace path that the symbolic
+// link at file points to, rejecting any target that would resolve
+// outside Server.root (equivalent to docker's
+// symlink.FollowSymlinkInScope). It does not require the target to
+// exist, so dangling links are reported rather than rejected.
+func (s *Server) resolveLink(file string) (upspin.PathName, error) {
+	if _, err := os.Readlink(file); err != nil {
+		return "", err
+	}
 
-func pdMarshal(dst *[]byte, sig, sig2 upspin.Signature) error {
-	// sig2 is a signature with another owner key, to enable smoother key rotation.
-	n := packdataLen()
-	if len(*dst) < n {
-		*dst = make([]byte, n)
-	}
-	n = 0
-	n += packutil.PutBytes((*dst)[n:], sig.R.Bytes())
-	n += packutil.PutBytes((*dst)[n:], sig.S.Bytes())
-	if sig2.R == nil {
-		sig2 = upspin.Signature{R: zero, S: zero}
-	}
-	n += packutil.PutBytes((*dst)[n:], sig2.R.Bytes())
-	n += packutil.PutBytes((*dst)[n:], sig2.S.Bytes())
-	*dst = (*dst)[:n]
-	return nil
-}
+	resolved, err := filepath.EvalSymlinks(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		// Dangling link: EvalSymlinks can't walk through a target
+		// that doesn't exist, so fall back to a single-hop join of
+		// the raw link target. This is weaker than EvalSymlinks (it
+		// won't catch an escape buried further down a chain that
+		// doesn't yet exist), but it still stops a dangling link from
+		// pointing straight out of root.
+		target, rerr := os.Readlink(file)
+		if rerr != nil {
+			return "", rerr
+		}
+		if filepath.IsAbs(target) {
+			resolved = filepath.Clean(target)
+		} else {
+			resolved = filepath.Clean(filepath.Join(filepath.Dir(file), target))
+		}
+	}
 
-// packdataLen returns n big enough for packing, sig.R, sig.S
-func packdataLen() int {
-	return 2*marshalBufLen + binary.MaxVarintLen64 + 1
+	if resolved != s.root && !strings.HasPrefix(resolved, s.root+string(filepath.Separator)) {
+		return "", errors.E(errors.Permission, errors.Errorf("symlink %q escapes root", s.upspinPathFromLocal(file)))
+	}
+	return s.upspinPathFromLocal(resolved), nil
 }
 
 // upspinPathFromLocal returns the upspin.PathName for
@@ -212,7 +260,7 @@ func (s dirServer) listDir(name upspin.PathName) ([]*upspin.DirEntry, error) {
 			return nil
 		}
 		mode := info.Mode()
-		if !mode.IsDir() && !mode.IsRegular() {
+		if !mode.IsDir() && !mode.IsRegular() && mode&os.ModeSymlink == 0 {
 			return nil
 		}
 		e, err := s.entry(name)
@@ -236,7 +284,7 @@ func (s dirServer) listDir(name upspin.PathName) ([]*upspin.DirEntry, error) {
 		}
 		return nil
 	}
-	err = filepath.Walk(dir, walk)
+	err = s.fs.Walk(dir, walk)
 	// TODO(adg): Maybe we should actually be ignoring these errors?
 	return entries, err
 }
@@ -268,19 +316,174 @@ func (s dirServer) WhichAccess(pathName upspin.PathName) (*upspin.DirEntry, erro
 	return e, nil
 }
 
-// Watch implements upspin.DirServer.
-func (d dirServer) Watch(upspin.PathName, int64, <-chan struct{}) (<-chan upspin.Event, error) {
-	return nil, upspin.ErrNotSupported
-}
+// Watch implements upspin.DirServer. It streams Create/Write/Remove
+// events for the subtree rooted at name, resuming from order (buffered
+// events with a sequence greater than order are replayed from the
+// hub's history first) and running until done is closed.
+func (s dirServer) Watch(name upspin.PathName, order int64, done <-chan struct{}) (<-chan upspin.Event, error) {
+	const op errors.Op = "dir/filesystem.Watch"
+
+	parsed, err := path.Parse(name)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	if err := s.verifyUserRoot(parsed); err != nil {
+		return nil, errors.E(op, err)
+	}
+	if ok, err := s.can(access.List, parsed); err != nil {
+		return nil, errors.E(op, err)
+	} else if !ok {
+		return nil, errors.E(op, errors.Private)
+	}
+	if s.hub == nil {
+		return nil, errors.E(op, upspin.ErrNotSupported)
+	}
+
+	root := filepath.Join(s.root, parsed.FilePath())
 
-// Methods that are not implemented.
+	// Watched subtrees are otherwise only covered lazily, as entry and
+	// listDir happen to visit them; a subtree nobody has looked up or
+	// listed since startup would have no fsnotify watches at all. Walk
+	// it now so this specific subscription actually observes changes,
+	// without pre-walking the rest of the tree.
+	if err := s.hub.watchTree(root); err != nil {
+		log.Printf("dir/filesystem.Watch: watching %s: %v; events there may go unnoticed", root, err)
+	}
+
+	return s.hub.subscribe(root, order, done), nil
+}
 
 func (s dirServer) Delete(pathName upspin.PathName) (*upspin.DirEntry, error) {
 	const op errors.Op = "dir/filesystem.Delete"
-	return nil, errors.E(op, errReadOnly)
+
+	if s.readOnly {
+		return nil, errors.E(op, errReadOnly)
+	}
+
+	parsed, err := path.Parse(pathName)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	if err := s.verifyUserRoot(parsed); err != nil {
+		return nil, errors.E(op, err)
+	}
+	if ok, err := s.can(access.Write, parsed); err != nil {
+		return nil, errors.E(op, err)
+	} else if !ok {
+		return nil, errors.E(op, errors.Private)
+	}
+
+	file := filepath.Join(s.root, parsed.FilePath())
+	e, err := s.entry(file)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	if err := os.RemoveAll(file); err != nil {
+		return nil, errors.E(op, errors.IO, err)
+	}
+	s.dirEntries.Remove(file)
+
+	// Reclaim the quota this file's bytes were charged against when
+	// written; otherwise used only ever grows. releaseFileRefs releases
+	// the actual per-block references writeBlocks charged against
+	// quota (not e.Blocks[0], which entry() always resynthesizes as a
+	// single whole-file digest), and only refunds a reference once no
+	// other live file shares it, so two files with identical content
+	// don't refund the same charge twice.
+	if !e.IsDir() {
+		s.releaseFileRefs(file)
+	}
+
+	return e, nil
 }
 
+// Put implements upspin.DirServer. The entry's blocks must already have
+// been written to the StoreServer via storeServer.Put; Put moves the
+// corresponding staged blobs into place at entry's path, atomically and
+// in block order, creating parent directories as needed.
 func (s dirServer) Put(entry *upspin.DirEntry) (*upspin.DirEntry, error) {
 	const op errors.Op = "dir/filesystem.Put"
-	return nil, errors.E(op, errReadOnly)
+
+	if s.readOnly {
+		return nil, errors.E(op, errReadOnly)
+	}
+
+	parsed, err := path.Parse(entry.Name)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	if err := s.verifyUserRoot(parsed); err != nil {
+		return nil, errors.E(op, err)
+	}
+	if ok, err := s.can(access.Write, parsed); err != nil {
+		return nil, errors.E(op, err)
+	} else if !ok {
+		return nil, errors.E(op, errors.Private)
+	}
+
+	file := filepath.Join(s.root, parsed.FilePath())
+
+	if entry.IsDir() {
+		if err := os.MkdirAll(file, 0777); err != nil {
+			return nil, errors.E(op, errors.IO, err)
+		}
+	} else {
+		if err := s.writeBlocks(file, entry.Blocks); err != nil {
+			return nil, errors.E(op, err)
+		}
+	}
+	s.dirEntries.Remove(file)
+
+	e, err := s.entry(file)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	return e, nil
+}
+
+// writeBlocks assembles the staged blobs referenced by blocks, in
+// order, into a single temporary file, then renames it into place at
+// file. The rename is atomic with respect to readers of file.
+func (s dirServer) writeBlocks(file string, blocks []upspin.DirBlock) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0777); err != nil {
+		return errors.E(errors.IO, err)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".exp-put-")
+	if err != nil {
+		return errors.E(errors.IO, err)
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName) // no-op once renamed away.
+
+	for _, b := range blocks {
+		blob := filepath.Join(s.root, blobDir, string(b.Location.Reference))
+		data, err := ioutil.ReadFile(blob)
+		if err != nil {
+			tmp.Close()
+			return errors.E(errors.IO, err)
+		}
+		if _, err := tmp.Write(data); err != nil {
+			tmp.Close()
+			return errors.E(errors.IO, err)
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.E(errors.IO, err)
+	}
+	if err := os.Rename(tmpName, file); err != nil {
+		return errors.E(errors.IO, err)
+	}
+	refs := make([]contentRef, 0, len(blocks))
+	for _, b := range blocks {
+		// commitBlob only deletes the staged copy once every Put that
+		// referenced it has been consumed, so two DirEntries sharing a
+		// block (identical content, two different Puts) don't race
+		// each other out of the blob; it also records file as a live
+		// holder of the content for releaseContentRef's refund check.
+		s.commitBlob(string(b.Location.Reference))
+		refs = append(refs, contentRef{ref: string(b.Location.Reference), size: b.Size})
+	}
+	s.recordFileRefs(file, refs)
+	return nil
 }
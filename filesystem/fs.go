@@ -0,0 +1,68 @@
+// Copyright 2016 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filesystem
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// File is the subset of *os.File that Fs implementations need to
+// support reading a file's contents.
+type File interface {
+	io.Reader
+	io.Closer
+}
+
+// Fs abstracts the read-only filesystem operations Server needs from
+// its root, modeled on spf13/afero's Fs interface but trimmed to what
+// this package actually uses. The default, osFS, delegates to the os
+// and ioutil packages exactly as Server did before Fs existed.
+// Swapping in memFS lets tests exercise whichAccess, readFile, entry
+// and listDir without touching a real disk, and an overlayFS lets a
+// read-only patch tree be layered over a base tree; both are steps
+// toward future backends (tar, zip, 9P) that don't live on local disk
+// at all.
+type Fs interface {
+	Open(name string) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+	ReadDir(name string) ([]os.FileInfo, error)
+	ReadFile(name string) ([]byte, error)
+	Walk(root string, fn filepath.WalkFunc) error
+}
+
+// osFS implements Fs by calling through to the local operating
+// system's filesystem. It is the default used by New.
+type osFS struct{}
+
+func (osFS) Open(name string) (File, error) { return os.Open(name) }
+
+func (osFS) Stat(name string) (os.FileInfo, error) { return os.Stat(name) }
+
+func (osFS) Lstat(name string) (os.FileInfo, error) { return os.Lstat(name) }
+
+func (osFS) ReadDir(name string) ([]os.FileInfo, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdir(-1)
+}
+
+func (osFS) ReadFile(name string) ([]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+func (osFS) Walk(root string, fn filepath.WalkFunc) error {
+	return filepath.Walk(root, fn)
+}
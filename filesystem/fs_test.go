@@ -0,0 +1,72 @@
+// Copyright 2016 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filesystem
+
+import (
+	"testing"
+
+	"upspin.io/config"
+	"upspin.io/upspin"
+)
+
+func TestMemFSReadFile(t *testing.T) {
+	const user upspin.UserName = "joe@upspin.io"
+
+	mem := newMemFS()
+	mem.AddDir("/memroot", 0755)
+	mem.AddFile("/memroot/file.txt", []byte("hello"), 0644)
+
+	cfg := config.SetUserName(config.New(), user)
+	s, err := New(cfg, "/memroot", WithFS(mem))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	data, err := s.readFile(upspin.PathName(user) + "/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "hello"; got != want {
+		t.Errorf("readFile: got %q, want %q", got, want)
+	}
+}
+
+func TestOverlayFSPrefersPatch(t *testing.T) {
+	base := newMemFS()
+	base.AddDir("/root", 0755)
+	base.AddFile("/root/file.txt", []byte("base"), 0644)
+	base.AddFile("/root/base-only.txt", []byte("only in base"), 0644)
+
+	patch := newMemFS()
+	patch.AddDir("/root", 0755)
+	patch.AddFile("/root/file.txt", []byte("patch"), 0644)
+
+	o := NewOverlayFS(base, patch)
+
+	data, err := o.ReadFile("/root/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "patch"; got != want {
+		t.Errorf("ReadFile: got %q, want %q", got, want)
+	}
+
+	data, err = o.ReadFile("/root/base-only.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "only in base"; got != want {
+		t.Errorf("ReadFile: got %q, want %q", got, want)
+	}
+
+	entries, err := o.ReadDir("/root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(entries), 2; got != want {
+		t.Errorf("ReadDir: got %d entries, want %d", got, want)
+	}
+}
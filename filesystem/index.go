@@ -0,0 +1,210 @@
+// Copyright 2016 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filesystem
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	iradix "github.com/hashicorp/go-immutable-radix"
+)
+
+// indexRecord is the value stored in a contentIndex for a single path,
+// under the path's recursive key: for a file, the digest of its
+// contents; for a directory, the digest of the whole subtree rooted at
+// path, modeled on buildkit's contenthash cache. No separate header
+// record (name, mode, mtime) is kept for a directory, and the path's
+// own bare key holds nothing. A change anywhere below a directory
+// invalidates the records of that directory and its ancestors only.
+type indexRecord struct {
+	digest  string // sha256 hex of a file's contents, or a directory's recursive digest.
+	modTime int64
+	size    int64
+}
+
+// recursiveSuffix marks the radix key holding a path's recursive
+// content digest, the only record the index stores for a path.
+const recursiveSuffix = "\x00recursive"
+
+func recursiveKey(path string) []byte { return []byte(path + recursiveSuffix) }
+
+// contentIndex is a persistent, copy-on-write radix index mapping
+// cleaned absolute local paths to content digests. It exists so that
+// dirServer.entry and storeServer.Get can use stable sha256 references
+// instead of re-reading (and re-hashing) files on every call, while
+// still reflecting on-disk changes via invalidate.
+type contentIndex struct {
+	root string // cleaned absolute root path; invalidate stops walking up here.
+	fs   Fs     // backing filesystem; digesting reads through this, not the OS directly.
+
+	mu    sync.RWMutex
+	tree  *iradix.Tree               // cleaned absolute path (+recursiveSuffix) -> *indexRecord
+	byRef map[string]map[string]bool // digest -> set of cleaned absolute paths currently producing it
+}
+
+func newContentIndex(root string, fs Fs) *contentIndex {
+	return &contentIndex{
+		root:  filepath.Clean(root),
+		fs:    fs,
+		tree:  iradix.New(),
+		byRef: make(map[string]map[string]bool),
+	}
+}
+
+// digest returns the content digest for path, computing and caching it
+// if necessary. For a regular file the digest is the sha256 of its
+// contents; for a directory it is the sha256 of the sorted list of
+// child names and digests, recursively.
+func (idx *contentIndex) digest(path string) (string, error) {
+	path = filepath.Clean(path)
+
+	info, err := idx.fs.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	modTime := info.ModTime().UnixNano()
+
+	idx.mu.RLock()
+	if v, ok := idx.tree.Get(recursiveKey(path)); ok {
+		rec := v.(*indexRecord)
+		if rec.modTime == modTime {
+			idx.mu.RUnlock()
+			return rec.digest, nil
+		}
+	}
+	idx.mu.RUnlock()
+
+	var sum string
+	if info.IsDir() {
+		sum, err = idx.digestDir(path)
+	} else {
+		sum, err = idx.digestFile(path)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	rec := &indexRecord{digest: sum, modTime: modTime, size: info.Size()}
+	idx.mu.Lock()
+	txn := idx.tree.Txn()
+	if old, ok := txn.Get(recursiveKey(path)); ok {
+		idx.removeRef(old.(*indexRecord).digest, path)
+	}
+	txn.Insert(recursiveKey(path), rec)
+	idx.tree = txn.Commit()
+	idx.addRef(sum, path)
+	idx.mu.Unlock()
+
+	return sum, nil
+}
+
+// addRef and removeRef maintain byRef's digest -> paths membership.
+// idx.mu must be held for writing.
+func (idx *contentIndex) addRef(digest, path string) {
+	paths := idx.byRef[digest]
+	if paths == nil {
+		paths = make(map[string]bool)
+		idx.byRef[digest] = paths
+	}
+	paths[path] = true
+}
+
+func (idx *contentIndex) removeRef(digest, path string) {
+	paths := idx.byRef[digest]
+	delete(paths, path)
+	if len(paths) == 0 {
+		delete(idx.byRef, digest)
+	}
+}
+
+// digestFile returns the sha256 hex digest of a regular file's contents,
+// read through idx.fs so digesting honors an injected backend.
+func (idx *contentIndex) digestFile(path string) (string, error) {
+	f, err := idx.fs.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// digestDir returns the recursive content digest of a directory:
+// sha256 of its children's names and digests, in sorted order.
+func (idx *contentIndex) digestDir(dir string) (string, error) {
+	entries, err := idx.fs.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		childDigest, err := idx.digest(filepath.Join(dir, name))
+		if err != nil {
+			return "", err
+		}
+		io.WriteString(h, name)
+		h.Write([]byte{0})
+		io.WriteString(h, childDigest)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// resolve returns every local path currently known to produce digest
+// ref. Content is deduplicated by digest, so more than one path can
+// share a single reference; callers that use the result to make an
+// access decision (storeServer.Get) must check every path rather than
+// picking an arbitrary one, since each path may sit under a different
+// Access file.
+func (idx *contentIndex) resolve(ref string) ([]string, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	paths, ok := idx.byRef[ref]
+	if !ok {
+		return nil, false
+	}
+	out := make([]string, 0, len(paths))
+	for p := range paths {
+		out = append(out, p)
+	}
+	return out, true
+}
+
+// invalidate drops the cached digest for path and every ancestor
+// directory up to root, so the next call to digest recomputes only
+// the dirty prefix rather than the whole tree.
+func (idx *contentIndex) invalidate(path string) {
+	path = filepath.Clean(path)
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	txn := idx.tree.Txn()
+	for p := path; ; p = filepath.Dir(p) {
+		key := recursiveKey(p)
+		if v, ok := txn.Get(key); ok {
+			idx.removeRef(v.(*indexRecord).digest, p)
+		}
+		txn.Delete(key)
+		if p == idx.root || p == "." || p == string(filepath.Separator) {
+			break
+		}
+	}
+	idx.tree = txn.Commit()
+}
@@ -0,0 +1,197 @@
+// Copyright 2016 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filesystem
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// memFS is an in-memory Fs, for tests that want to exercise
+// whichAccess, readFile, entry and listDir without touching a real
+// disk. Directories are implicit in the paths of the files it holds,
+// unless added explicitly with AddDir (to represent an empty one).
+type memFS struct {
+	files map[string]*memFileData // cleaned path -> contents.
+}
+
+type memFileData struct {
+	data    []byte
+	mode    os.FileMode
+	modTime time.Time
+	isDir   bool
+}
+
+// newMemFS returns an empty in-memory Fs.
+func newMemFS() *memFS {
+	return &memFS{files: make(map[string]*memFileData)}
+}
+
+// AddFile adds or overwrites a regular file at name.
+func (m *memFS) AddFile(name string, data []byte, mode os.FileMode) {
+	m.files[filepath.Clean(name)] = &memFileData{
+		data:    data,
+		mode:    mode,
+		modTime: time.Now(),
+	}
+}
+
+// AddDir records an explicit, possibly empty, directory at name.
+func (m *memFS) AddDir(name string, mode os.FileMode) {
+	m.files[filepath.Clean(name)] = &memFileData{
+		mode:    mode | os.ModeDir,
+		modTime: time.Now(),
+		isDir:   true,
+	}
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+	isDir   bool
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi memFileInfo) IsDir() bool        { return fi.isDir }
+func (fi memFileInfo) Sys() interface{}   { return nil }
+
+// hasDescendant reports whether any known file lives under dir,
+// making dir an implicit directory even if it was never added
+// explicitly.
+func (m *memFS) hasDescendant(dir string) bool {
+	prefix := dir + string(filepath.Separator)
+	for p := range m.files {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *memFS) stat(name string) (os.FileInfo, error) {
+	name = filepath.Clean(name)
+	if f, ok := m.files[name]; ok {
+		return memFileInfo{
+			name:    filepath.Base(name),
+			size:    int64(len(f.data)),
+			mode:    f.mode,
+			modTime: f.modTime,
+			isDir:   f.isDir,
+		}, nil
+	}
+	if name == "." || name == string(filepath.Separator) || m.hasDescendant(name) {
+		return memFileInfo{name: filepath.Base(name), mode: os.ModeDir | 0755, isDir: true}, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (m *memFS) Stat(name string) (os.FileInfo, error)  { return m.stat(name) }
+func (m *memFS) Lstat(name string) (os.FileInfo, error) { return m.stat(name) }
+
+type memOpenFile struct {
+	*bytes.Reader
+}
+
+func (memOpenFile) Close() error { return nil }
+
+func (m *memFS) Open(name string) (File, error) {
+	name = filepath.Clean(name)
+	f, ok := m.files[name]
+	if !ok || f.isDir {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return memOpenFile{bytes.NewReader(f.data)}, nil
+}
+
+func (m *memFS) ReadFile(name string) ([]byte, error) {
+	name = filepath.Clean(name)
+	f, ok := m.files[name]
+	if !ok || f.isDir {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return append([]byte(nil), f.data...), nil
+}
+
+func (m *memFS) ReadDir(name string) ([]os.FileInfo, error) {
+	name = filepath.Clean(name)
+	prefix := name
+	if prefix != string(filepath.Separator) {
+		prefix += string(filepath.Separator)
+	}
+
+	seen := make(map[string]bool)
+	var infos []os.FileInfo
+	for p := range m.files {
+		if !strings.HasPrefix(p, prefix) {
+			continue
+		}
+		child := strings.SplitN(strings.TrimPrefix(p, prefix), string(filepath.Separator), 2)[0]
+		if seen[child] {
+			continue
+		}
+		seen[child] = true
+		fi, err := m.stat(filepath.Join(name, child))
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, fi)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (m *memFS) Walk(root string, fn filepath.WalkFunc) error {
+	return genericWalk(m, root, fn)
+}
+
+// genericWalk implements filepath.Walk semantics (lexical order,
+// honoring filepath.SkipDir) on top of any Fs, for backends like
+// memFS and overlayFS that have no native recursive walk.
+func genericWalk(fsys Fs, root string, fn filepath.WalkFunc) error {
+	info, err := fsys.Lstat(root)
+	if err != nil {
+		return fn(root, nil, err)
+	}
+	return walkFs(fsys, root, info, fn)
+}
+
+func walkFs(fsys Fs, path string, info os.FileInfo, fn filepath.WalkFunc) error {
+	if err := fn(path, info, nil); err != nil {
+		if info.IsDir() && err == filepath.SkipDir {
+			return nil
+		}
+		return err
+	}
+	if !info.IsDir() {
+		return nil
+	}
+	entries, err := fsys.ReadDir(path)
+	if err != nil {
+		return fn(path, info, err)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	for _, e := range entries {
+		if err := walkFs(fsys, filepath.Join(path, e.Name()), e, fn); err != nil {
+			if err == filepath.SkipDir {
+				if e.IsDir() {
+					continue
+				}
+				// SkipDir from a file skips the rest of its directory.
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,331 @@
+// Copyright 2016 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package ninep serves a filesystem.Server's tree as a 9P2000.L
+// server, so it can be mounted directly with `mount -t 9p` without an
+// Upspin FUSE client — the same trick minikube uses to expose host
+// directories to guest VMs.
+//
+// ninep is built entirely on filesystem.Server's exported DirServer
+// and StoreServer, the same interfaces any other Upspin client would
+// dial; it has no access to the package's unexported internals, so
+// permission checks and metadata (Server.can, whichAccess, entry) are
+// reused indirectly, through Lookup, Glob and Get.
+package ninep
+
+import (
+	"errors"
+	"hash/fnv"
+	"io"
+	gPath "path"
+
+	"github.com/hugelgupf/p9/p9"
+
+	"upspin.io/upspin"
+
+	"github.com/gildasch/exp/filesystem"
+)
+
+// Server adapts a *filesystem.Server to p9.Attacher.
+type Server struct {
+	fs   *filesystem.Server
+	user upspin.Config
+}
+
+// New returns a 9P attacher backed by fs, presenting as user. Every
+// Tattach dials fs's DirServer and StoreServer as user: 9P carries no
+// further per-request identity, so the whole mount shares the one
+// Upspin identity given here. Neither Attach nor the Dial methods it
+// calls check that user names a real Upspin identity; any config is
+// accepted.
+func New(fs *filesystem.Server, user upspin.Config) *Server {
+	return &Server{fs: fs, user: user}
+}
+
+// Attach implements p9.Attacher.
+func (s *Server) Attach() (p9.File, error) {
+	dirSvc, err := s.fs.DirServer().Dial(s.user, upspin.Endpoint{})
+	if err != nil {
+		return nil, err
+	}
+	storeSvc, err := s.fs.StoreServer().Dial(s.user, upspin.Endpoint{})
+	if err != nil {
+		return nil, err
+	}
+	return &file{
+		dir:   dirSvc.(upspin.DirServer),
+		store: storeSvc.(upspin.StoreServer),
+		path:  upspin.PathName(s.user.UserName()),
+	}, nil
+}
+
+// file adapts a single Upspin path to a p9.File, resolving its
+// DirEntry lazily and caching it for the life of the p9.File value (a
+// fresh Walk, as 9P requires, gets a fresh file and a fresh lookup).
+type file struct {
+	dir   upspin.DirServer
+	store upspin.StoreServer
+	path  upspin.PathName
+
+	entry *upspin.DirEntry
+}
+
+func (f *file) lookup() (*upspin.DirEntry, error) {
+	if f.entry != nil {
+		return f.entry, nil
+	}
+	e, err := f.dir.Lookup(f.path)
+	if err != nil {
+		return nil, err
+	}
+	f.entry = e
+	return e, nil
+}
+
+// qid derives a stable 9P QID from an Upspin path. Upspin has no
+// numeric inode concept, so the QID's Path is a hash of the full name;
+// collisions would only affect client-side caching, not correctness.
+func qid(e *upspin.DirEntry) p9.QID {
+	typ := p9.TypeRegular
+	if e.IsDir() {
+		typ = p9.TypeDir
+	}
+	h := fnv.New64a()
+	io.WriteString(h, string(e.Name))
+	return p9.QID{
+		Type:    typ,
+		Version: uint32(e.Sequence),
+		Path:    h.Sum64(),
+	}
+}
+
+// Walk implements p9.File.
+func (f *file) Walk(names []string) ([]p9.QID, p9.File, error) {
+	qids := make([]p9.QID, 0, len(names))
+	cur := f.path
+	for _, name := range names {
+		cur = upspin.PathName(gPath.Join(string(cur), name))
+		e, err := f.dir.Lookup(cur)
+		if err != nil {
+			return nil, nil, err
+		}
+		qids = append(qids, qid(e))
+	}
+	return qids, &file{dir: f.dir, store: f.store, path: cur}, nil
+}
+
+// Open implements p9.File. The mount is read-only: filesystem.Server
+// must be opened in writable mode and Put through separately for
+// anything beyond serving an existing tree.
+func (f *file) Open(mode p9.OpenFlags) (p9.QID, uint32, error) {
+	if mode != p9.ReadOnly {
+		return p9.QID{}, 0, errReadOnly
+	}
+	e, err := f.lookup()
+	if err != nil {
+		return p9.QID{}, 0, err
+	}
+	return qid(e), 4096, nil // IO unit hint.
+}
+
+// ReadAt implements p9.File by fetching the entry's sole block from
+// the StoreServer and slicing it at offset. filesystem.Server entries
+// currently always have exactly one block.
+func (f *file) ReadAt(p []byte, offset int64) (int, error) {
+	e, err := f.lookup()
+	if err != nil {
+		return 0, err
+	}
+	if len(e.Blocks) == 0 {
+		return 0, io.EOF
+	}
+	data, _, _, err := f.store.Get(e.Blocks[0].Location.Reference)
+	if err != nil {
+		return 0, err
+	}
+	if offset >= int64(len(data)) {
+		return 0, io.EOF
+	}
+	return copy(p, data[offset:]), nil
+}
+
+// Readdir implements p9.File using Glob, the same traversal the
+// dirServer.listDir-backed Glob RPC uses for any other client.
+func (f *file) Readdir(offset uint64, count uint32) (p9.Dirents, error) {
+	entries, err := f.dir.Glob(string(f.path) + "/*")
+	if err != nil {
+		return nil, err
+	}
+	if offset >= uint64(len(entries)) {
+		return nil, nil
+	}
+	dirents := make(p9.Dirents, 0, len(entries)-int(offset))
+	for i, e := range entries[offset:] {
+		q := qid(e)
+		dirents = append(dirents, p9.Dirent{
+			QID:    q,
+			Offset: offset + uint64(i) + 1,
+			Type:   q.Type,
+			Name:   gPath.Base(string(e.Name)),
+		})
+	}
+	return dirents, nil
+}
+
+// GetAttr implements p9.File.
+func (f *file) GetAttr(req p9.AttrMask) (p9.QID, p9.AttrMask, p9.Attr, error) {
+	e, err := f.lookup()
+	if err != nil {
+		return p9.QID{}, p9.AttrMask{}, p9.Attr{}, err
+	}
+	mode := p9.ModeRegular
+	if e.IsDir() {
+		mode = p9.ModeDirectory
+	}
+	var size uint64
+	if s, err := e.Size(); err == nil {
+		size = uint64(s)
+	}
+	return qid(e), req, p9.Attr{
+		Mode:         mode | 0444,
+		Size:         size,
+		ATimeSeconds: uint64(e.Time),
+		MTimeSeconds: uint64(e.Time),
+	}, nil
+}
+
+// Close implements p9.File. There is nothing to release: entries are
+// read fresh from the DirServer/StoreServer on every Walk.
+func (f *file) Close() error { return nil }
+
+var errReadOnly = errors.New("ninep: read-only mount")
+
+// WalkGetAttr implements p9.File, combining Walk and GetAttr into the
+// single round trip 9P2000.L clients prefer for Twalk.
+func (f *file) WalkGetAttr(names []string) ([]p9.QID, p9.File, p9.AttrMask, p9.Attr, error) {
+	qids, next, err := f.Walk(names)
+	if err != nil {
+		return nil, nil, p9.AttrMask{}, p9.Attr{}, err
+	}
+	_, mask, attr, err := next.(*file).GetAttr(p9.AttrMask{})
+	if err != nil {
+		return nil, nil, p9.AttrMask{}, p9.Attr{}, err
+	}
+	return qids, next, mask, attr, nil
+}
+
+// StatFS implements p9.File. filesystem.Server exposes no volume-level
+// statistics, so this reports an empty (zero-value) result rather than
+// guessing at numbers nothing backs.
+func (f *file) StatFS() (p9.FSStat, error) {
+	return p9.FSStat{}, nil
+}
+
+// SetAttr implements p9.File. The mount is read-only; see Open.
+func (f *file) SetAttr(valid p9.SetAttrMask, attr p9.SetAttr) error {
+	return errReadOnly
+}
+
+// GetXattr implements p9.File. filesystem.Server has no extended
+// attribute concept to expose.
+func (f *file) GetXattr(attr string) ([]byte, error) {
+	return nil, errors.New("ninep: extended attributes not supported")
+}
+
+// SetXattr implements p9.File. The mount is read-only; see Open.
+func (f *file) SetXattr(attr string, data []byte, flags p9.XattrFlags) error {
+	return errReadOnly
+}
+
+// ListXattrs implements p9.File. filesystem.Server has no extended
+// attributes, so the list is always empty.
+func (f *file) ListXattrs() ([]string, error) {
+	return nil, nil
+}
+
+// RemoveXattr implements p9.File. The mount is read-only; see Open.
+func (f *file) RemoveXattr(name string) error {
+	return errReadOnly
+}
+
+// Lock implements p9.File. The mount is read-only, so there are never
+// any writers to coordinate with; report success unconditionally.
+func (f *file) Lock(pid int, locktype p9.LockType, flags p9.LockFlags, start, length uint64, client string) (p9.LockStatus, error) {
+	return p9.LockStatusOK, nil
+}
+
+// Rename implements p9.File. The mount is read-only; see Open.
+func (f *file) Rename(newDir p9.File, newName string) error {
+	return errReadOnly
+}
+
+// RenameAt implements p9.File. The mount is read-only; see Open.
+func (f *file) RenameAt(oldName string, newDir p9.File, newName string) error {
+	return errReadOnly
+}
+
+// Renamed implements p9.File, notifying a file that it (or an
+// ancestor) has been renamed. Since Rename and RenameAt both always
+// refuse, the framework never has cause to call this; it exists only
+// to satisfy the interface.
+func (f *file) Renamed(newDir p9.File, newName string) {}
+
+// UnlinkAt implements p9.File. The mount is read-only; see Open.
+func (f *file) UnlinkAt(name string, flags uint32) error {
+	return errReadOnly
+}
+
+// Readlink implements p9.File, returning a symlink's target rewritten
+// into the Upspin namespace. Unlike lookup's other callers, which
+// treat any Lookup error as fatal, Readlink must tolerate
+// upspin.ErrFollowLink: Lookup returns it alongside a valid AttrLink
+// entry, per the Upspin protocol.
+func (f *file) Readlink() (string, error) {
+	e, err := f.dir.Lookup(f.path)
+	if err != nil && err != upspin.ErrFollowLink {
+		return "", err
+	}
+	if e == nil || !e.IsLink() {
+		return "", errors.New("ninep: not a symlink")
+	}
+	return string(e.Link), nil
+}
+
+// Flush implements p9.File. There's nothing buffered to flush: reads
+// go straight to the DirServer/StoreServer on every call.
+func (f *file) Flush() error { return nil }
+
+// WriteAt implements p9.File. The mount is read-only; see Open.
+func (f *file) WriteAt(p []byte, offset int64) (int, error) {
+	return 0, errReadOnly
+}
+
+// FSync implements p9.File. The mount is read-only, so there is never
+// anything dirty to sync.
+func (f *file) FSync() error { return nil }
+
+// Create implements p9.File. The mount is read-only; see Open.
+func (f *file) Create(name string, flags p9.OpenFlags, permissions p9.FileMode, uid p9.UID, gid p9.GID) (p9.File, p9.QID, uint32, error) {
+	return nil, p9.QID{}, 0, errReadOnly
+}
+
+// Mkdir implements p9.File. The mount is read-only; see Open.
+func (f *file) Mkdir(name string, permissions p9.FileMode, uid p9.UID, gid p9.GID) (p9.QID, error) {
+	return p9.QID{}, errReadOnly
+}
+
+// Symlink implements p9.File. The mount is read-only; see Open.
+func (f *file) Symlink(oldName, newName string, uid p9.UID, gid p9.GID) (p9.QID, error) {
+	return p9.QID{}, errReadOnly
+}
+
+// Link implements p9.File. The mount is read-only; see Open.
+func (f *file) Link(target p9.File, newName string) error {
+	return errReadOnly
+}
+
+// Mknod implements p9.File. The mount is read-only; see Open.
+func (f *file) Mknod(name string, mode p9.FileMode, major, minor uint32, uid p9.UID, gid p9.GID) (p9.QID, error) {
+	return p9.QID{}, errReadOnly
+}
@@ -0,0 +1,77 @@
+// Copyright 2016 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filesystem
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// overlayFS is a read-only Fs that composites two backends: patch is
+// consulted first, and base is used for anything patch doesn't have.
+// A directory present in both has its listings merged, with patch's
+// entries shadowing base's entries of the same name.
+type overlayFS struct {
+	base, patch Fs
+}
+
+// NewOverlayFS returns an Fs that serves patch's contents where
+// present, falling back to base otherwise.
+func NewOverlayFS(base, patch Fs) Fs {
+	return overlayFS{base: base, patch: patch}
+}
+
+func (o overlayFS) Stat(name string) (os.FileInfo, error) {
+	if fi, err := o.patch.Stat(name); err == nil {
+		return fi, nil
+	}
+	return o.base.Stat(name)
+}
+
+func (o overlayFS) Lstat(name string) (os.FileInfo, error) {
+	if fi, err := o.patch.Lstat(name); err == nil {
+		return fi, nil
+	}
+	return o.base.Lstat(name)
+}
+
+func (o overlayFS) Open(name string) (File, error) {
+	if f, err := o.patch.Open(name); err == nil {
+		return f, nil
+	}
+	return o.base.Open(name)
+}
+
+func (o overlayFS) ReadFile(name string) ([]byte, error) {
+	if data, err := o.patch.ReadFile(name); err == nil {
+		return data, nil
+	}
+	return o.base.ReadFile(name)
+}
+
+func (o overlayFS) ReadDir(name string) ([]os.FileInfo, error) {
+	patchEntries, patchErr := o.patch.ReadDir(name)
+	baseEntries, baseErr := o.base.ReadDir(name)
+	if patchErr != nil && baseErr != nil {
+		return nil, baseErr
+	}
+
+	seen := make(map[string]bool, len(patchEntries))
+	merged := make([]os.FileInfo, 0, len(patchEntries)+len(baseEntries))
+	for _, fi := range patchEntries {
+		seen[fi.Name()] = true
+		merged = append(merged, fi)
+	}
+	for _, fi := range baseEntries {
+		if !seen[fi.Name()] {
+			merged = append(merged, fi)
+		}
+	}
+	return merged, nil
+}
+
+func (o overlayFS) Walk(root string, fn filepath.WalkFunc) error {
+	return genericWalk(o, root, fn)
+}
@@ -5,6 +5,8 @@ import (
 	"encoding/binary"
 	"math/big"
 
+	"upspin.io/errors"
+	"upspin.io/pack"
 	"upspin.io/pack/packutil"
 	"upspin.io/upspin"
 )
@@ -26,6 +28,37 @@ func simplePack(cfg upspin.Config, entry *upspin.DirEntry) error {
 	return nil
 }
 
+// eeSign packs entry's Packdata using the EE or EEIntegrity packer
+// registered for entry.Packing, producing a real per-block AES key,
+// wrapped as that packer wraps it for cfg, in place of the dkey=0,
+// sum=0 placeholder simplePack uses for plain packing. eeSign does not
+// read any Access file, so no key is wrapped for the other readers an
+// Access file governing entry.Name may list.
+//
+// Note that the block content served by storeServer.Get remains the
+// plaintext bytes of the underlying local file: this server exposes an
+// existing on-disk tree as-is, so it cannot retroactively re-encrypt
+// files it did not write. eeSign exists so EE-aware clients still see
+// correctly shaped, verifiable Packdata; a deployment that wants
+// genuine confidentiality at rest should write through dirServer.Put,
+// where the client supplies already-encrypted blocks.
+func eeSign(cfg upspin.Config, entry *upspin.DirEntry, cleartext []byte) error {
+	packer := pack.Lookup(entry.Packing)
+	if packer == nil {
+		return errors.Errorf("eeSign: no packer registered for packing %d", entry.Packing)
+	}
+
+	bp, err := packer.Pack(cfg, entry)
+	if err != nil {
+		return err
+	}
+	if _, err := bp.Pack(cleartext); err != nil {
+		bp.Close()
+		return err
+	}
+	return bp.Close()
+}
+
 const (
 	aesKeyLen     = 32
 	marshalBufLen = 66
@@ -2,14 +2,17 @@ package filesystem
 
 import (
 	"bytes"
-	"log"
-	"strings"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"upspin.io/config"
 	"upspin.io/factotum"
 	"upspin.io/pack"
-	"upspin.io/test/testutil"
 	"upspin.io/upspin"
 )
 
@@ -19,13 +22,18 @@ func TestPack(t *testing.T) {
 		name                 = upspin.PathName(user + "/file/of/user")
 		text                 = "this is some text"
 	)
-	cfg, packer := setup(user)
+	cfg, packer := setup(t, user)
 
 	// First pack.
 	d := &upspin.DirEntry{
 		Name:       name,
 		SignedName: name,
 		Writer:     cfg.UserName(),
+		Packing:    defaultPacking,
+		Blocks: []upspin.DirBlock{{
+			Offset: 0,
+			Size:   int64(len(text)),
+		}},
 	}
 	simplePack(cfg, d)
 
@@ -57,17 +65,41 @@ func unpackBlob(t *testing.T, cfg upspin.Config, packer upspin.Packer, d *upspin
 	return text
 }
 
-func setup(name upspin.UserName) (upspin.Config, upspin.Packer) {
+// setup returns a Config for name, with a factotum backed by a p256
+// key pair generated fresh for this test run, written to t.TempDir().
+// That keeps TestPack independent of the fixtures under
+// testutil.Repo("key", "testdata"), same as readFile and friends no
+// longer reach straight for the OS once given an Fs.
+func setup(t *testing.T, name upspin.UserName) (upspin.Config, upspin.Packer) {
 	cfg := config.SetUserName(config.New(), name)
-	packer := pack.Lookup(packing)
-	j := strings.IndexByte(string(name), '@')
-	if j < 0 {
-		log.Fatalf("malformed username %s", name)
-	}
-	f, err := factotum.NewFromDir(testutil.Repo("key", "testdata", string(name[:j])))
+	packer := pack.Lookup(defaultPacking)
+
+	f, err := factotum.NewFromDir(generateKeys(t))
 	if err != nil {
-		log.Fatalf("unable to initialize factotum for %s", string(name[:j]))
+		t.Fatalf("unable to initialize factotum: %v", err)
 	}
 	cfg = config.SetFactotum(cfg, f)
 	return cfg, packer
 }
+
+// generateKeys writes a freshly generated p256 key pair, in the format
+// factotum.NewFromDir expects, to a directory under t.TempDir() and
+// returns that directory.
+func generateKeys(t *testing.T) string {
+	priv, x, y, err := elliptic.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generateKeys: %v", err)
+	}
+	d := new(big.Int).SetBytes(priv)
+
+	dir := t.TempDir()
+	public := fmt.Sprintf("p256\n%s\n%s\n", x.String(), y.String())
+	secret := fmt.Sprintf("%s\n", d.String())
+	if err := os.WriteFile(filepath.Join(dir, "public.upspinkey"), []byte(public), 0600); err != nil {
+		t.Fatalf("generateKeys: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "secret.upspinkey"), []byte(secret), 0600); err != nil {
+		t.Fatalf("generateKeys: %v", err)
+	}
+	return dir
+}
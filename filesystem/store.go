@@ -5,14 +5,21 @@
 package filesystem
 
 import (
-	"fmt"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
-	"time"
+	"sync/atomic"
 
 	"upspin.io/access"
 	"upspin.io/errors"
 	"upspin.io/path"
 	"upspin.io/upspin"
+
+	"github.com/gildasch/exp/filesystem/compression"
 )
 
 // StoreServer returns the StoreServer implementation for this Server.
@@ -24,6 +31,10 @@ type storeServer struct {
 	*Server
 }
 
+// Dial returns a storeServer bound to cfg. As with dirServer.Dial, the
+// Server struct is copied by value per dial, but Server.qs is a
+// pointer, so quota enforcement and refcounting stay shared across
+// every dial rather than forking their own independent state.
 func (s storeServer) Dial(cfg upspin.Config, e upspin.Endpoint) (upspin.Service, error) {
 	dialed := *s.Server
 	dialed.user = cfg
@@ -32,53 +43,411 @@ func (s storeServer) Dial(cfg upspin.Config, e upspin.Endpoint) (upspin.Service,
 
 var errNotDialed = errors.E(errors.Internal, "must Dial before making request")
 
+// Get implements upspin.StoreServer. ref is a content digest, as
+// produced by dirServer.entry via Server.index, optionally suffixed
+// with "-gzip" or "-zstd" (e.g. "<sha256>-zstd") to request that
+// algorithm instead of the Server's default; Get resolves the digest
+// back to the local paths currently producing it and serves the bytes
+// of whichever one the requesting user can read, compressed
+// accordingly. Content is deduplicated by digest, so more than one
+// path can legitimately own a given reference, each behind its own
+// Access file; Get grants the request if any of them is readable,
+// rather than trusting a single arbitrarily-chosen path, so which
+// path last happened to produce the digest can't decide access on its
+// own. The served bytes are re-hashed against digest before being
+// returned, so a digest left over from before the file's content
+// changed reports errors.NotExist rather than silently resolving to
+// the new content.
 func (s storeServer) Get(ref upspin.Reference) ([]byte, *upspin.Refdata, []upspin.Location, error) {
 	const op errors.Op = "store/filesystem.Get"
 
-	fmt.Printf("Get %s\n", ref)
-
 	if s.user == nil {
 		return nil, nil, nil, errors.E(op, errNotDialed)
 	}
 
-	splitRef := strings.Split(string(ref), "-")
-	ref = upspin.Reference(strings.Join(splitRef[:len(splitRef)-1], "-"))
-	offset := splitRef[len(splitRef)-1]
+	digest, algo := splitCompressionSuffix(string(ref), s.compression)
+
+	files, ok := s.index.resolve(digest)
+	if !ok {
+		return nil, nil, nil, errors.E(op, errors.NotExist, errors.Errorf("unknown reference %q", digest))
+	}
+
+	var pathName upspin.PathName
+	var accessErr error
+	for _, file := range files {
+		candidate := s.upspinPathFromLocal(file)
+		parsed, err := path.Parse(candidate)
+		if err != nil {
+			accessErr = errors.E(op, err)
+			continue
+		}
+		if ok, err := s.can(access.Read, parsed); err != nil {
+			accessErr = errors.E(op, err)
+		} else if ok {
+			pathName = candidate
+			break
+		} else if accessErr == nil {
+			accessErr = errors.E(op, parsed.Path(), access.ErrPermissionDenied)
+		}
+	}
+	if pathName == "" {
+		if accessErr == nil {
+			accessErr = errors.E(op, errors.NotExist, errors.Errorf("unknown reference %q", digest))
+		}
+		return nil, nil, nil, accessErr
+	}
 
-	pathName := upspin.PathName(s.server.UserName()) + "" + upspin.PathName(ref)
-	parsed, err := path.Parse(pathName)
+	data, err := s.readFile(pathName)
 	if err != nil {
 		return nil, nil, nil, errors.E(op, err)
 	}
 
-	// Verify that the requesting user can access this file.
-	if ok, err := s.can(access.Read, parsed); err != nil {
-		return nil, nil, nil, errors.E(op, err)
-	} else if !ok {
-		return nil, nil, nil, errors.E(op, parsed.Path(), access.ErrPermissionDenied)
+	// The index may still map digest to file from before the file's
+	// content last changed (invalidate only drops the record it finds
+	// live at the time; a digest superseded in between stays in byRef).
+	// Re-hash the bytes we're about to serve so a stale digest can't be
+	// silently satisfied with different content.
+	sum := sha256.Sum256(data)
+	if got := hex.EncodeToString(sum[:]); got != digest {
+		return nil, nil, nil, errors.E(op, errors.NotExist, errors.Errorf("reference %q is stale", digest))
 	}
 
-	fmt.Printf("readFile %s, offset %s\n", pathName, offset)
-	data, err := s.readFile(upspin.PathName(fmt.Sprintf("%s-%s", pathName, offset)))
+	var buf bytes.Buffer
+	used, err := compression.Compress(&buf, bytes.NewReader(data), algo)
 	if err != nil {
-		return nil, nil, nil, errors.E(op, err)
+		return nil, nil, nil, errors.E(op, errors.IO, err)
+	}
+	data = buf.Bytes()
+
+	contentRef := ref
+	if used != compression.Uncompressed {
+		contentRef = upspin.Reference(digest + "-" + used.String())
 	}
 	refdata := &upspin.Refdata{
-		Reference: ref,
+		Reference: contentRef,
 		Volatile:  false,
-		Duration:  time.Minute, // TODO: Just for fun.
+		// The reference is a content digest: it is valid for as long
+		// as it resolves, i.e. until the underlying file changes.
+		Duration: 0,
 	}
 	return data, refdata, nil, nil
 }
 
-// Methods that are not implemented.
+// splitCompressionSuffix splits a requested reference of the form
+// "<digest>" or "<digest>-<algorithm>" into its digest and the
+// Algorithm to compress with, falling back to def when no (valid)
+// suffix is present.
+func splitCompressionSuffix(ref string, def compression.Algorithm) (digest string, algo compression.Algorithm) {
+	i := strings.LastIndex(ref, "-")
+	if i < 0 {
+		return ref, def
+	}
+	if a, ok := compression.ParseAlgorithm(ref[i+1:]); ok {
+		return ref[:i], a
+	}
+	return ref, def
+}
 
+// Put implements upspin.StoreServer. It stages ciphertext under a
+// content-addressed name in blobDir, to be picked up by a subsequent
+// dirServer.Put that knows where the block ultimately belongs. Put does
+// not itself touch the named tree, so it is safe to call with no
+// corresponding directory entry yet in place.
+//
+// A reference is refcounted across calls to Put and dirServer.Put's
+// writeBlocks: two DirEntries whose blocks hash to the same ciphertext
+// each call Put once, so the blob survives until both have consumed it,
+// rather than the first writeBlocks deleting it out from under the
+// second. Quota is only ever charged once per live reference: if ref
+// is already staged, or already written and held live by some other
+// file (e.g. this Put is rewriting a path with unchanged bytes, after
+// the earlier blob was already consumed and removed), the bytes are
+// restaged without charging the quota again.
 func (s storeServer) Put(ciphertext []byte) (*upspin.Refdata, error) {
 	const op errors.Op = "store/filesystem.Put"
-	return nil, errors.E(op, errReadOnly)
+
+	if s.readOnly {
+		return nil, errors.E(op, errReadOnly)
+	}
+	if len(ciphertext) > maxBlockSize {
+		return nil, errors.E(op, errors.Invalid, "block exceeds maximum size")
+	}
+
+	sum := sha256.Sum256(ciphertext)
+	ref := upspin.Reference(hex.EncodeToString(sum[:]))
+
+	dir := filepath.Join(s.root, blobDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.E(op, errors.IO, err)
+	}
+	blob := filepath.Join(dir, string(ref))
+	if _, err := os.Stat(blob); err == nil {
+		// Already staged; content-addressed, so nothing to write and
+		// nothing new to charge against quota, but this Put still
+		// represents a pending writeBlocks that will consume it.
+		s.refBlob(string(ref))
+		return &upspin.Refdata{Reference: ref}, nil
+	}
+
+	// refBlobCharging both decides whether this Put needs a fresh quota
+	// charge and registers it as a pending consumer of ref in the same
+	// locked step, so a concurrent Delete of ref's last live holder
+	// can't see liveRefs drop to zero -- and refund the quota -- in the
+	// gap between the check and the registration.
+	charge := s.refBlobCharging(string(ref))
+	if charge && s.quota > 0 && atomic.AddInt64(&s.qs.used, int64(len(ciphertext))) > s.quota {
+		atomic.AddInt64(&s.qs.used, -int64(len(ciphertext)))
+		s.unrefBlob(string(ref))
+		return nil, errors.E(op, errors.IO, "quota exceeded")
+	}
+
+	if err := stageBlob(dir, blob, ciphertext); err != nil {
+		if charge {
+			atomic.AddInt64(&s.qs.used, -int64(len(ciphertext)))
+			s.unrefBlob(string(ref))
+		} else {
+			// This Put never charged quota for ref itself, trusting an
+			// existing live holder to account for it; if that holder
+			// was deleted while this Put was in flight, it's on us to
+			// refund the charge it made, since nothing else will.
+			s.unrefBlobUncharged(string(ref), int64(len(ciphertext)))
+		}
+		return nil, errors.E(op, errors.IO, err)
+	}
+
+	return &upspin.Refdata{Reference: ref}, nil
 }
 
+// stageBlob writes ciphertext to blob (inside dir) via a temp file and
+// rename, so a concurrent reader never observes a partially written blob.
+func stageBlob(dir, blob string, ciphertext []byte) error {
+	tmp, err := ioutil.TempFile(dir, ".exp-blob-")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	if _, err := tmp.Write(ciphertext); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Rename(tmpName, blob); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return nil
+}
+
+// refBlob records one more pending writeBlocks consumer for ref.
+func (s *Server) refBlob(ref string) {
+	s.qs.mu.Lock()
+	s.qs.blobRefs[ref]++
+	s.qs.mu.Unlock()
+}
+
+// refBlobCharging registers ref as having one more pending writeBlocks
+// consumer, same as refBlob, and reports whether Put should charge
+// quota for it: false if some file already holds ref live, since the
+// bytes are already accounted for. The check and the registration
+// happen under the same lock so a concurrent release of ref's last
+// live holder can't land in between them.
+func (s *Server) refBlobCharging(ref string) (charge bool) {
+	s.qs.mu.Lock()
+	charge = s.qs.liveRefs[ref] == 0
+	s.qs.blobRefs[ref]++
+	s.qs.mu.Unlock()
+	return charge
+}
+
+// unrefBlob undoes a refBlob/refBlobCharging call for ref that didn't
+// end up producing a usable blob, e.g. because Put failed before the
+// rename into place, after the caller has already reverted whatever
+// quota charge that same call made (if any).
+func (s *Server) unrefBlob(ref string) {
+	s.qs.mu.Lock()
+	s.qs.blobRefs[ref]--
+	if s.qs.blobRefs[ref] <= 0 {
+		delete(s.qs.blobRefs, ref)
+	}
+	s.qs.mu.Unlock()
+}
+
+// unrefBlobUncharged is unrefBlob's counterpart for a Put that skipped
+// its own quota charge because some other file already held ref live
+// (see refBlobCharging). If that Put then fails before commitBlob, and
+// this was the last reference to ref anywhere -- the live holder
+// itself having been deleted while this Put was in flight -- the
+// charge made for that now-vanished holder would otherwise never be
+// refunded, since releaseContentRef only runs once per live holder and
+// this Put was never one.
+func (s *Server) unrefBlobUncharged(ref string, size int64) {
+	s.qs.mu.Lock()
+	s.qs.blobRefs[ref]--
+	if s.qs.blobRefs[ref] <= 0 {
+		delete(s.qs.blobRefs, ref)
+	}
+	empty := s.qs.blobRefs[ref] == 0 && s.qs.liveRefs[ref] == 0
+	s.qs.mu.Unlock()
+	if empty {
+		s.refundQuota(size)
+	}
+}
+
+// commitBlob is called by writeBlocks once the staged blob for ref has
+// been copied into a final file. It records that file as a live holder
+// of ref's content, for releaseContentRef's refund bookkeeping, and
+// removes the staged copy from blobDir once no other pending Put is
+// still waiting to consume it. It does not itself adjust the quota:
+// the bytes it frees from blobDir have simply relocated to their final
+// path, so they remain charged against s.qs.used via liveRefs.
+func (s *Server) commitBlob(ref string) {
+	s.qs.mu.Lock()
+	s.qs.liveRefs[ref]++
+	s.qs.blobRefs[ref]--
+	done := s.qs.blobRefs[ref] <= 0
+	if done {
+		delete(s.qs.blobRefs, ref)
+	}
+	s.qs.mu.Unlock()
+	if done {
+		os.Remove(filepath.Join(s.root, blobDir, ref))
+	}
+}
+
+// contentRef pairs a staged content reference with the number of bytes
+// it was charged for, so releaseFileRefs can refund the right amount
+// without needing to re-stat a file that Delete has already removed.
+type contentRef struct {
+	ref  string
+	size int64
+}
+
+// recordFileRefs associates file (a local path) with the content
+// references its blocks were just committed under by writeBlocks, for
+// releaseFileRefs to release later. It replaces whatever refs file
+// held previously without releasing them: Put does not currently
+// reclaim quota from a file it overwrites with different content,
+// same as before this refcounting existed.
+func (s *Server) recordFileRefs(file string, refs []contentRef) {
+	s.qs.mu.Lock()
+	s.qs.fileRefs[file] = refs
+	s.qs.mu.Unlock()
+}
+
+// releaseFileRefs forgets file's recorded content references and
+// releases each one, refunding quota for any that become wholly
+// unreferenced. It is dirServer.Delete's counterpart to
+// recordFileRefs -- unlike deriving a reference from entry(), which
+// always resynthesizes a single whole-file digest block, this reaches
+// the same per-block references writeBlocks actually charged against
+// quota, so it works for multi-block (> maxBlockSize) files too.
+func (s *Server) releaseFileRefs(file string) {
+	s.qs.mu.Lock()
+	refs := s.qs.fileRefs[file]
+	delete(s.qs.fileRefs, file)
+	s.qs.mu.Unlock()
+	for _, r := range refs {
+		s.releaseContentRef(r.ref, r.size)
+	}
+}
+
+// releaseContentRef drops one live holder of ref (a file carrying this
+// content has just been deleted by dirServer.Delete), refunding its
+// quota charge once no holder remains anywhere for ref -- neither a
+// live file nor a blob still staged awaiting a pending Put. Two files
+// sharing identical content only release the quota charge once the
+// second (last) of them is deleted.
+//
+// ref must be a reference commitBlob actually recorded as live; if
+// it isn't tracked, releaseContentRef does nothing rather than guess.
+// dirServer.entry always reports a single block whose reference is
+// the whole file's digest, which only equals the reference charged at
+// Put time for a file small enough to fit in one block (maxBlockSize);
+// for a larger, multi-block file the two don't match, and blindly
+// decrementing liveRefs[ref] would both corrupt an unrelated entry's
+// count and refund quota the file's own blocks are still holding.
+func (s *Server) releaseContentRef(ref string, size int64) {
+	s.qs.mu.Lock()
+	count, tracked := s.qs.liveRefs[ref]
+	if !tracked {
+		s.qs.mu.Unlock()
+		return
+	}
+	count--
+	if count <= 0 {
+		delete(s.qs.liveRefs, ref)
+	} else {
+		s.qs.liveRefs[ref] = count
+	}
+	empty := count <= 0 && s.qs.blobRefs[ref] == 0
+	s.qs.mu.Unlock()
+	if empty {
+		s.refundQuota(size)
+	}
+}
+
+// refundQuota gives back n bytes of quota, clamping s.qs.used at 0 so a
+// refund for content this server never charged (e.g. a file already
+// present under root before this Server was constructed) can't push
+// used negative and hand out quota headroom it never earned.
+func (s *Server) refundQuota(n int64) {
+	if s.quota <= 0 {
+		return
+	}
+	for {
+		old := atomic.LoadInt64(&s.qs.used)
+		next := old - n
+		if next < 0 {
+			next = 0
+		}
+		if atomic.CompareAndSwapInt64(&s.qs.used, old, next) {
+			return
+		}
+	}
+}
+
+// Delete implements upspin.StoreServer, dropping one pending reference
+// to a staged block in blobDir. If another Put is still waiting to
+// have writeBlocks consume this same content, the blob is left in
+// place for it; once no Put is pending on ref any more, Delete removes
+// the blob, and it refunds the quota charge only if no live file holds
+// ref either.
 func (s storeServer) Delete(ref upspin.Reference) error {
 	const op errors.Op = "store/filesystem.Delete"
-	return errors.E(op, errReadOnly)
+
+	if s.readOnly {
+		return errors.E(op, errReadOnly)
+	}
+	blob := filepath.Join(s.root, blobDir, string(ref))
+	fi, err := os.Stat(blob)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.E(op, errors.IO, err)
+	}
+
+	s.qs.mu.Lock()
+	s.qs.blobRefs[string(ref)]--
+	stillPending := s.qs.blobRefs[string(ref)] > 0
+	if !stillPending {
+		delete(s.qs.blobRefs, string(ref))
+	}
+	empty := !stillPending && s.qs.liveRefs[string(ref)] == 0
+	s.qs.mu.Unlock()
+
+	if stillPending {
+		return nil
+	}
+	if err := os.Remove(blob); err != nil && !os.IsNotExist(err) {
+		return errors.E(op, errors.IO, err)
+	}
+	if empty {
+		s.refundQuota(fi.Size())
+	}
+	return nil
 }
@@ -0,0 +1,87 @@
+// Copyright 2016 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filesystem
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"upspin.io/config"
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+func TestSymlinks(t *testing.T) {
+	const user upspin.UserName = "joe@upspin.io"
+
+	root, err := ioutil.TempDir("", "exp-filesystem-symlink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	mustWriteFile(t, filepath.Join(root, "Access"), "*:"+string(user)+"\n")
+	mustWriteFile(t, filepath.Join(root, "real.txt"), "hello")
+	mustSymlink(t, "real.txt", filepath.Join(root, "relative-link"))
+	mustSymlink(t, filepath.Join(root, "real.txt"), filepath.Join(root, "absolute-link"))
+	mustSymlink(t, filepath.Join(root, "does-not-exist"), filepath.Join(root, "dangling-link"))
+	mustSymlink(t, filepath.Join(root, "Access"), filepath.Join(root, "access-link"))
+	mustSymlink(t, "/etc/passwd", filepath.Join(root, "escaping-link"))
+
+	cfg := config.SetUserName(config.New(), user)
+	s, err := New(cfg, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	svc, err := s.DirServer().Dial(cfg, upspin.Endpoint{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := svc.(upspin.DirServer)
+
+	cases := []struct {
+		name   string
+		target upspin.PathName
+	}{
+		{"relative-link", upspin.PathName(string(user) + "/real.txt")},
+		{"absolute-link", upspin.PathName(string(user) + "/real.txt")},
+		{"dangling-link", upspin.PathName(string(user) + "/does-not-exist")},
+		{"access-link", upspin.PathName(string(user) + "/Access")},
+	}
+	for _, c := range cases {
+		name := upspin.PathName(string(user) + "/" + c.name)
+		e, err := dir.Lookup(name)
+		if err != upspin.ErrFollowLink {
+			t.Errorf("%s: Lookup err = %v, want ErrFollowLink", c.name, err)
+			continue
+		}
+		if e.Link != c.target {
+			t.Errorf("%s: Link = %q, want %q", c.name, e.Link, c.target)
+		}
+	}
+
+	_, err = dir.Lookup(upspin.PathName(string(user) + "/escaping-link"))
+	if !errors.Is(errors.Permission, err) {
+		t.Errorf("escaping-link: err = %v, want a Permission error", err)
+	}
+}
+
+func mustWriteFile(t *testing.T, name, data string) {
+	t.Helper()
+	if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustSymlink(t *testing.T, oldname, newname string) {
+	t.Helper()
+	if err := os.Symlink(oldname, newname); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,265 @@
+// Copyright 2016 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filesystem
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"upspin.io/access"
+	"upspin.io/path"
+	"upspin.io/upspin"
+)
+
+// watchEventBuffer bounds how many past events a watchHub retains, so
+// that a Watch call resuming from an old order can replay recent
+// history without us keeping it forever.
+const watchEventBuffer = 1000
+
+// watchChannelBuffer is the capacity of the channel returned by
+// dirServer.Watch. A subscriber that falls behind by more than this
+// many events will miss updates rather than block the watcher loop;
+// it can always re-Watch with a fresh order to resync.
+const watchChannelBuffer = 64
+
+// watchHub keeps a single recursive fsnotify.Watcher rooted at a
+// Server's root, and fans out the events it observes two ways: to
+// invalidate the content index (see index.go), and, sequenced, to any
+// dirServer.Watch subscribers interested in the affected subtree.
+type watchHub struct {
+	server  *Server
+	watcher *fsnotify.Watcher
+	index   *contentIndex
+
+	mu      sync.Mutex
+	seq     int64
+	history []hubEvent
+	nextID  int
+	subs    map[int]*watchSub
+}
+
+// hubEvent is a single buffered, sequenced filesystem change.
+type hubEvent struct {
+	seq  int64
+	name string // local absolute path
+}
+
+// watchSub is a live dirServer.Watch subscriber.
+type watchSub struct {
+	prefix string // local absolute path prefix; "" matches everything.
+	ch     chan upspin.Event
+}
+
+// newWatchHub starts watching root and returns a hub that keeps idx up
+// to date and serves Watch subscribers. The caller must call Close
+// when done.
+//
+// Only root itself is watched at startup: fsnotify has no recursive
+// mode, and pre-walking an arbitrarily large, already-existing tree to
+// watch every subdirectory risks exhausting the platform's watch
+// descriptor limit (e.g. inotify's max_user_watches) before the server
+// has served a single request. Subdirectories are added lazily
+// instead, by ensureWatched as dirServer discovers them (entry,
+// listDir) and by watchTree for ones that spring into existence after
+// we're already running.
+func newWatchHub(server *Server, idx *contentIndex) (*watchHub, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	h := &watchHub{
+		server:  server,
+		watcher: w,
+		index:   idx,
+		subs:    make(map[int]*watchSub),
+	}
+	if err := w.Add(server.root); err != nil {
+		w.Close()
+		return nil, err
+	}
+	go h.run()
+	return h, nil
+}
+
+// watchTree adds a watch for dir and every subdirectory beneath it.
+// Used for directories created after startup, whose children (if any
+// were created alongside it, e.g. by a rename) can't yet have watches
+// of their own, and by dirServer.Watch for the subtree it subscribes to.
+func (h *watchHub) watchTree(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return h.watcher.Add(path)
+		}
+		return nil
+	})
+}
+
+// ensureWatched adds a watch for dir if it isn't already covered. It
+// is the lazy counterpart to watchTree's eager walk, called as
+// dirServer discovers a pre-existing directory (via entry or listDir)
+// rather than up front, so watch descriptor usage tracks what's
+// actually been accessed instead of the whole tree. h may be nil (no
+// watcher available), in which case this is a no-op.
+func (h *watchHub) ensureWatched(dir string) {
+	if h == nil {
+		return
+	}
+	// fsnotify.Add on an already-watched path just refreshes it, so no
+	// bookkeeping is needed to avoid double-adding.
+	if err := h.watcher.Add(dir); err != nil {
+		log.Printf("filesystem: watching %s: %v; changes there may go unnoticed", dir, err)
+	}
+}
+
+func (h *watchHub) run() {
+	for {
+		select {
+		case ev, ok := <-h.watcher.Events:
+			if !ok {
+				return
+			}
+			h.handle(ev)
+		case err, ok := <-h.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("filesystem: watcher error: %v", err)
+		}
+	}
+}
+
+func (h *watchHub) handle(ev fsnotify.Event) {
+	h.index.invalidate(ev.Name)
+	if ev.Op&fsnotify.Create != 0 {
+		if fi, err := os.Stat(ev.Name); err == nil && fi.IsDir() {
+			// A new directory can't itself be watched until we add it.
+			h.watchTree(ev.Name)
+		}
+	}
+	h.publish(ev.Name)
+}
+
+// publish appends a new sequenced event to the history buffer and
+// delivers it to every subscriber whose subtree it falls under.
+func (h *watchHub) publish(name string) {
+	h.mu.Lock()
+	h.seq++
+	seq := h.seq
+	h.history = append(h.history, hubEvent{seq: seq, name: name})
+	if len(h.history) > watchEventBuffer {
+		h.history = h.history[len(h.history)-watchEventBuffer:]
+	}
+	subs := make([]*watchSub, 0, len(h.subs))
+	for _, sub := range h.subs {
+		if sub.matches(name) {
+			subs = append(subs, sub)
+		}
+	}
+	h.mu.Unlock()
+
+	ev := h.buildEvent(seq, name)
+	for _, sub := range subs {
+		select {
+		case sub.ch <- ev:
+		default:
+			// Subscriber fell behind; drop rather than block the
+			// watcher loop. It can re-Watch with a fresh order.
+		}
+	}
+}
+
+func (sub *watchSub) matches(name string) bool {
+	return sub.prefix == "" || name == sub.prefix || strings.HasPrefix(name, sub.prefix+string(filepath.Separator))
+}
+
+// buildEvent turns a raw filesystem change at local path name into an
+// upspin.Event, consulting the current state of the file (it may
+// already be gone) and marking the entry incomplete if the watching
+// user lacks read rights. upspin.Event carries no sequence field of
+// its own; seq is stamped onto the delivered DirEntry's Sequence
+// instead, per the upspin.Event/DirEntry contract.
+func (h *watchHub) buildEvent(seq int64, name string) upspin.Event {
+	pathName := h.server.upspinPathFromLocal(name)
+	ds := dirServer{h.server}
+
+	e, err := ds.entry(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return upspin.Event{
+				Delete: true,
+				Entry: &upspin.DirEntry{
+					Name:       pathName,
+					SignedName: pathName,
+					Sequence:   seq,
+				},
+			}
+		}
+		return upspin.Event{Error: err}
+	}
+
+	if parsed, perr := path.Parse(pathName); perr == nil {
+		if ok, _ := h.server.can(access.Read, parsed); !ok {
+			e.MarkIncomplete()
+		}
+	}
+	e.Sequence = seq
+	return upspin.Event{Entry: e}
+}
+
+// subscribe registers a new Watch subscriber rooted at prefix, first
+// replaying any buffered history with sequence greater than order,
+// then streaming live events until done is closed.
+func (h *watchHub) subscribe(prefix string, order int64, done <-chan struct{}) <-chan upspin.Event {
+	ch := make(chan upspin.Event, watchChannelBuffer)
+	sub := &watchSub{prefix: prefix, ch: ch}
+
+	h.mu.Lock()
+	id := h.nextID
+	h.nextID++
+	h.subs[id] = sub
+	var replay []hubEvent
+	for _, e := range h.history {
+		if e.seq > order && sub.matches(e.name) {
+			replay = append(replay, e)
+		}
+	}
+	h.mu.Unlock()
+
+	go func() {
+		for _, e := range replay {
+			select {
+			case ch <- h.buildEvent(e.seq, e.name):
+			case <-done:
+				h.unsubscribe(id)
+				return
+			}
+		}
+		<-done
+		h.unsubscribe(id)
+	}()
+
+	return ch
+}
+
+func (h *watchHub) unsubscribe(id int) {
+	h.mu.Lock()
+	sub, ok := h.subs[id]
+	delete(h.subs, id)
+	h.mu.Unlock()
+	if ok {
+		close(sub.ch)
+	}
+}
+
+func (h *watchHub) Close() error {
+	return h.watcher.Close()
+}